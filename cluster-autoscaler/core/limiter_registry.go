@@ -0,0 +1,169 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// NodeGroupRateLimitConfig overrides the global rate-limit settings for a
+// single node group. A zero value in any field means "inherit the global
+// config's value" rather than "zero quota".
+type NodeGroupRateLimitConfig struct {
+	// MaxNumberOfNodesPerMin overrides the global targeted nodes-per-minute
+	// rate for this node group.
+	MaxNumberOfNodesPerMin int
+	// BurstMaxNumberOfNodesPerMin overrides the global burst nodes-per-minute
+	// rate for this node group.
+	BurstMaxNumberOfNodesPerMin int
+}
+
+// ScaleUpLimiterConfig configures a ScaleUpLimiterRegistry: the defaults
+// applied to the parent global limiter and to every node group, plus any
+// per-node-group overrides.
+type ScaleUpLimiterConfig struct {
+	// MaxNumberOfNodesPerMin is the global and default per-node-group
+	// targeted nodes-per-minute rate.
+	MaxNumberOfNodesPerMin int
+	// BurstMaxNumberOfNodesPerMin is the global and default per-node-group
+	// burst nodes-per-minute rate.
+	BurstMaxNumberOfNodesPerMin int
+	// MaxUnreadyNodes is applied to the global limiter and every node-group
+	// limiter.
+	MaxUnreadyNodes int
+	// MaxUnreadyPercentage is applied to the global limiter and every
+	// node-group limiter.
+	MaxUnreadyPercentage float64
+	// MaxNodeProvisioningTime is applied to the global limiter and every
+	// node-group limiter.
+	MaxNodeProvisioningTime time.Duration
+	// HealthProvider is applied to the global limiter and every node-group
+	// limiter so the unready-node gating added for direct ScaleUpRateLimiter
+	// use also applies to callers going through the registry. If nil, the
+	// unready-node gating is skipped, same as an unset ScaleUpRateLimiter.
+	HealthProvider NodeHealthProvider
+	// PerNodeGroup holds overrides keyed by node-group ID. A node group
+	// absent from this map uses the config's defaults unchanged.
+	PerNodeGroup map[string]NodeGroupRateLimitConfig
+}
+
+// ScaleUpLimiterRegistry keeps one ScaleUpRateLimiter per node group plus a
+// parent global limiter, and requires a scale-up request to be granted by
+// both before admitting it. This stops one hot node group from starving all
+// the others under the global cap.
+type ScaleUpLimiterRegistry struct {
+	config ScaleUpLimiterConfig
+	global *ScaleUpRateLimiter
+	groups map[string]*ScaleUpRateLimiter
+	mu     sync.Mutex
+}
+
+// NewScaleUpLimiterRegistry creates a ScaleUpLimiterRegistry with a parent
+// global limiter built from config, and no node-group limiters yet; those
+// are created lazily, on first use, per node group.
+func NewScaleUpLimiterRegistry(config ScaleUpLimiterConfig) *ScaleUpLimiterRegistry {
+	return &ScaleUpLimiterRegistry{
+		config: config,
+		global: newLimiterFromConfig(config.MaxNumberOfNodesPerMin, config.BurstMaxNumberOfNodesPerMin, config),
+		groups: make(map[string]*ScaleUpRateLimiter),
+	}
+}
+
+// newLimiterFromConfig builds a ScaleUpRateLimiter sharing the unready-node
+// gating and provisioning timeout of config, but with its own rate-limit
+// rates.
+func newLimiterFromConfig(maxNumberOfNodesPerMin, burstMaxNumberOfNodesPerMin int, config ScaleUpLimiterConfig) *ScaleUpRateLimiter {
+	return &ScaleUpRateLimiter{
+		maxNumberOfNodesPerMin:      maxNumberOfNodesPerMin,
+		burstMaxNumberOfNodesPerMin: burstMaxNumberOfNodesPerMin,
+		maxUnreadyNodes:             config.MaxUnreadyNodes,
+		maxUnreadyPercentage:        config.MaxUnreadyPercentage,
+		maxNodeProvisioningTime:     config.MaxNodeProvisioningTime,
+		healthProvider:              config.HealthProvider,
+	}
+}
+
+// limiterForGroup returns the node-group limiter for nodeGroupID, creating
+// it from config.PerNodeGroup (falling back to the registry's global rates)
+// on first use.
+func (r *ScaleUpLimiterRegistry) limiterForGroup(nodeGroupID string) *ScaleUpRateLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if limiter, ok := r.groups[nodeGroupID]; ok {
+		return limiter
+	}
+
+	maxNumberOfNodesPerMin := r.config.MaxNumberOfNodesPerMin
+	burstMaxNumberOfNodesPerMin := r.config.BurstMaxNumberOfNodesPerMin
+	if override, ok := r.config.PerNodeGroup[nodeGroupID]; ok {
+		if override.MaxNumberOfNodesPerMin > 0 {
+			maxNumberOfNodesPerMin = override.MaxNumberOfNodesPerMin
+		}
+		if override.BurstMaxNumberOfNodesPerMin > 0 {
+			burstMaxNumberOfNodesPerMin = override.BurstMaxNumberOfNodesPerMin
+		}
+	}
+
+	limiter := newLimiterFromConfig(maxNumberOfNodesPerMin, burstMaxNumberOfNodesPerMin, r.config)
+	r.groups[nodeGroupID] = limiter
+	return limiter
+}
+
+// AcquireNodes tries to reserve a number of nodes for scale up of the given
+// node group. The request must be granted by both the node group's own
+// limiter and the parent global limiter; if the global limiter refuses or
+// only partially grants, the node group's excess grant is rolled back so it
+// isn't silently lost.
+//
+// The group and global checks each go through acquireNodesNoMetrics, not
+// AcquireNodes, so this records the autoscaler_scaleup_* metrics exactly
+// once per call, with the true admitted count — not once per internal
+// limiter consulted.
+func (r *ScaleUpLimiterRegistry) AcquireNodes(nodeGroupID string, newNodes int) (bool, int, Reason) {
+	group := r.limiterForGroup(nodeGroupID)
+
+	ok, granted, reason := group.acquireNodesNoMetrics(newNodes)
+	if !ok {
+		recordAcquireMetrics(nil, newNodes, 0, reason, group.availableSlotsSnapshot(), group.lastReserveAtSnapshot())
+		return false, 0, reason
+	}
+
+	ok, grantedByGlobal, reason := r.global.acquireNodesNoMetrics(granted)
+	if !ok {
+		group.releaseDirect(granted)
+		recordAcquireMetrics(nil, newNodes, 0, reason, r.global.availableSlotsSnapshot(), r.global.lastReserveAtSnapshot())
+		return false, 0, reason
+	}
+	if grantedByGlobal < granted {
+		group.releaseDirect(granted - grantedByGlobal)
+	}
+
+	recordAcquireMetrics(nil, newNodes, grantedByGlobal, ReasonNone, r.global.availableSlotsSnapshot(), r.global.lastReserveAtSnapshot())
+	return true, grantedByGlobal, ReasonNone
+}
+
+// releaseDirect returns count nodes' worth of quota to the limiter's pool.
+// Unlike ReleaseNodes, it isn't tied to a ReserveNodes reservation; it's used
+// by ScaleUpLimiterRegistry to unwind a group grant the parent limiter didn't
+// honor.
+func (t *ScaleUpRateLimiter) releaseDirect(count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollbackLocked(count)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import "testing"
+
+// TestAcquireNodesRollsBackPartialGlobalGrant verifies that when the group
+// limiter grants more than the global limiter is willing to, the excess is
+// returned to the group's pool instead of being silently lost.
+//
+// This is deliberately set up so the global limiter's burst (9) is smaller
+// than the node group's (10) and both start fresh, so the partial grant
+// comes from comparing the two limiters' independent budgets rather than
+// from wall-clock GCRA refill — making the outcome exact, not timing-
+// dependent.
+func TestAcquireNodesRollsBackPartialGlobalGrant(t *testing.T) {
+	registry := NewScaleUpLimiterRegistry(ScaleUpLimiterConfig{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 9,
+		PerNodeGroup: map[string]NodeGroupRateLimitConfig{
+			"ng-1": {
+				MaxNumberOfNodesPerMin:      600,
+				BurstMaxNumberOfNodesPerMin: 10,
+			},
+		},
+	})
+
+	ok, granted, reason := registry.AcquireNodes("ng-1", 10)
+	if !ok || granted != 9 || reason != ReasonNone {
+		t.Fatalf("AcquireNodes(ng-1, 10) = (%v, %d, %q), want (true, 9, ReasonNone)", ok, granted, reason)
+	}
+
+	// ng-1's own limiter granted all 10 before the global limiter capped it
+	// at 9; the excess must have been rolled back to ng-1's pool rather than
+	// silently lost.
+	group := registry.limiterForGroup("ng-1")
+	if headroom := group.availableSlotsSnapshot(); headroom != 1 {
+		t.Fatalf("ng-1 available slots after rollback = %d, want 1", headroom)
+	}
+}
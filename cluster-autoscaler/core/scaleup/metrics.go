@@ -0,0 +1,99 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scaleup
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	nodesRequestedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "autoscaler_scaleup_nodes_requested_total",
+		Help: "Number of nodes requested from the scale-up rate limiter.",
+	})
+	nodesGrantedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "autoscaler_scaleup_nodes_granted_total",
+		Help: "Number of nodes the scale-up rate limiter has granted.",
+	})
+	nodesDeniedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "autoscaler_scaleup_nodes_denied_total",
+		Help: "Number of scale-up requests the rate limiter has denied, by reason.",
+	}, []string{"reason"})
+	unusedSlots = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "autoscaler_scaleup_unused_slots",
+		Help: "Number of node slots the scale-up rate limiter could grant right now.",
+	})
+	timeSinceLastReserveSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "autoscaler_scaleup_time_since_last_reserve_seconds",
+		Help: "Seconds elapsed since the scale-up rate limiter last granted any nodes.",
+	})
+)
+
+// Event is a structured record of a single AcquireNodes decision, for
+// operators who need to tell whether scale-up stalls are caused by the rate
+// limiter or by the cloud provider.
+type Event struct {
+	// Requested is the number of nodes that were asked for.
+	Requested int
+	// Granted is the number of nodes that were actually granted; zero if
+	// Reason is not ReasonNone.
+	Granted int
+	// Reason explains a refusal; ReasonNone on a granted request.
+	Reason Reason
+	// BurstHeadroom is the number of node slots still available
+	// immediately after this decision.
+	BurstHeadroom int
+	// Time is when the decision was made.
+	Time time.Time
+}
+
+// EventSink receives a structured Event for every AcquireNodes decision.
+type EventSink interface {
+	OnScaleUpDecision(Event)
+}
+
+// recordAcquireMetrics updates the shared scale-up metrics for a single
+// admission decision and, if sink is set, reports it as an Event.
+//
+// requested may be non-positive (e.g. invalid caller input); it is only
+// counted against nodesRequestedTotal when positive, since Counter.Add
+// panics on a negative value.
+func recordAcquireMetrics(sink EventSink, requested, granted int, reason Reason, headroom int, lastReserveAt time.Time) {
+	if requested > 0 {
+		nodesRequestedTotal.Add(float64(requested))
+	}
+	if reason == ReasonNone {
+		nodesGrantedTotal.Add(float64(granted))
+	} else {
+		nodesDeniedTotal.WithLabelValues(string(reason)).Inc()
+	}
+	unusedSlots.Set(float64(headroom))
+	timeSinceLastReserveSeconds.Set(time.Since(lastReserveAt).Seconds())
+
+	if sink != nil {
+		sink.OnScaleUpDecision(Event{
+			Requested:     requested,
+			Granted:       granted,
+			Reason:        reason,
+			BurstHeadroom: headroom,
+			Time:          time.Now(),
+		})
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scaleup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeEventSink struct {
+	events []Event
+}
+
+func (f *fakeEventSink) OnScaleUpDecision(e Event) {
+	f.events = append(f.events, e)
+}
+
+func TestRecordAcquireMetricsOnGrant(t *testing.T) {
+	requestedBefore := testutil.ToFloat64(nodesRequestedTotal)
+	grantedBefore := testutil.ToFloat64(nodesGrantedTotal)
+	sink := &fakeEventSink{}
+
+	lastReserveAt := time.Now()
+	recordAcquireMetrics(sink, 5, 5, ReasonNone, 3, lastReserveAt)
+
+	if got := testutil.ToFloat64(nodesRequestedTotal) - requestedBefore; got != 5 {
+		t.Fatalf("nodesRequestedTotal increased by %v, want 5", got)
+	}
+	if got := testutil.ToFloat64(nodesGrantedTotal) - grantedBefore; got != 5 {
+		t.Fatalf("nodesGrantedTotal increased by %v, want 5", got)
+	}
+	if got := testutil.ToFloat64(unusedSlots); got != 3 {
+		t.Fatalf("unusedSlots = %v, want 3", got)
+	}
+
+	if len(sink.events) != 1 {
+		t.Fatalf("EventSink received %d events, want 1", len(sink.events))
+	}
+	got := sink.events[0]
+	if got.Requested != 5 || got.Granted != 5 || got.Reason != ReasonNone || got.BurstHeadroom != 3 {
+		t.Fatalf("Event = %+v, want Requested=5 Granted=5 Reason=ReasonNone BurstHeadroom=3", got)
+	}
+}
+
+func TestRecordAcquireMetricsOnDenial(t *testing.T) {
+	deniedBefore := testutil.ToFloat64(nodesDeniedTotal.WithLabelValues(string(ReasonRateLimited)))
+	sink := &fakeEventSink{}
+
+	recordAcquireMetrics(sink, 5, 0, ReasonRateLimited, 0, time.Now())
+
+	if got := testutil.ToFloat64(nodesDeniedTotal.WithLabelValues(string(ReasonRateLimited))) - deniedBefore; got != 1 {
+		t.Fatalf("nodesDeniedTotal{reason=RateLimited} increased by %v, want 1", got)
+	}
+	if len(sink.events) != 1 || sink.events[0].Reason != ReasonRateLimited {
+		t.Fatalf("EventSink events = %+v, want one event with Reason=ReasonRateLimited", sink.events)
+	}
+}
+
+func TestRecordAcquireMetricsSkipsNonPositiveRequested(t *testing.T) {
+	requestedBefore := testutil.ToFloat64(nodesRequestedTotal)
+
+	// requested <= 0 must not reach nodesRequestedTotal.Add, which panics on
+	// a negative value.
+	recordAcquireMetrics(nil, -1, 0, ReasonRateLimited, 0, time.Now())
+
+	if got := testutil.ToFloat64(nodesRequestedTotal); got != requestedBefore {
+		t.Fatalf("nodesRequestedTotal changed to %v after a non-positive request, want unchanged at %v", got, requestedBefore)
+	}
+}
+
+func TestRecordAcquireMetricsNilSinkIsNoop(t *testing.T) {
+	// Must not panic when no EventSink is configured.
+	recordAcquireMetrics(nil, 1, 1, ReasonNone, 0, time.Now())
+}
@@ -17,49 +17,434 @@ limitations under the License.
 package scaleup
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 )
 
+// Reason identifies why AcquireNodes refused to grant (all or part of) a
+// scale-up request.
+type Reason string
+
+const (
+	// ReasonNone is returned alongside a granted request; there is nothing
+	// to report.
+	ReasonNone Reason = ""
+	// ReasonRateLimited means the request was throttled by the
+	// MaxNumberOfNodesPerMin/BurstMaxNumberOfNodesPerMin GCRA budget.
+	ReasonRateLimited Reason = "RateLimited"
+	// ReasonTooManyUnready means the request was refused because the
+	// cluster already has too many unready nodes, per MaxUnreadyNodes/
+	// MaxUnreadyPercentage.
+	ReasonTooManyUnready Reason = "TooManyUnready"
+)
+
+// NodeHealthProvider reports on the current health of the cluster's nodes so
+// that ScaleUpRateLimiter can avoid piling on more nodes while the cluster is
+// already struggling.
+type NodeHealthProvider interface {
+	// UnreadyCount returns the number of unready nodes and the total
+	// number of nodes currently in the cluster.
+	UnreadyCount() (unready, total int)
+}
+
+// ReservationID identifies a pending, unconfirmed grant of node quota made
+// through ReserveNodes.
+type ReservationID uint64
+
+// pendingReservation tracks a still-unconfirmed ReserveNodes grant: how many
+// nodes it covers, and the deadline by which it must be confirmed or
+// released before the sweeper reclaims it.
+type pendingReservation struct {
+	count    int
+	deadline time.Time
+}
+
 // ScaleUpRateLimiter represents a rate limiter for scaling up nodes.
 // It manages the number of nodes that can be added per minute based on a
 // maximum limit and a burst limit.
+//
+// Internally it implements the Generic Cell Rate Algorithm (GCRA): instead of
+// tracking a coarse integer-minute window, it tracks a single theoretical
+// arrival time (TAT) and advances it by one emission interval per granted
+// node. This gives smooth, per-second quota accumulation instead of bursty
+// behavior at minute boundaries.
 type ScaleUpRateLimiter struct {
 	// targeted number of nodes per min
 	MaxNumberOfNodesPerMin int
 	// burst number of nodes per min
 	BurstMaxNumberOfNodesPerMin int
-	// node slots that haven't been used in the previous iteration
-	UnusedNodeSlots int
-	// last reserve time
-	LastReserve time.Time
-	mu          sync.Mutex
+	// MaxUnreadyNodes is the maximum number of unready nodes tolerated
+	// before scale-up is refused, regardless of rate-limit headroom.
+	MaxUnreadyNodes int
+	// MaxUnreadyPercentage is the maximum percentage of unready nodes
+	// tolerated before scale-up is refused, regardless of rate-limit
+	// headroom.
+	MaxUnreadyPercentage float64
+	// HealthProvider reports the current unready/total node counts used to
+	// evaluate MaxUnreadyNodes/MaxUnreadyPercentage. If nil, the unready
+	// gating is skipped entirely.
+	HealthProvider NodeHealthProvider
+	// MaxNodeProvisioningTime bounds how long a ReserveNodes grant may stay
+	// unconfirmed before the sweeper reclaims its slots back to the pool.
+	MaxNodeProvisioningTime time.Duration
+	// OnReservationExpired, if set, is invoked by the sweeper whenever a
+	// reservation's MaxNodeProvisioningTime deadline passes without being
+	// confirmed or released.
+	OnReservationExpired func(id ReservationID, count int)
+	// EventSink, if set, receives a structured Event for every AcquireNodes
+	// decision (requested, granted, denied reason, burst headroom).
+	EventSink EventSink
+	// theoreticalArrivalTime is the GCRA TAT: the time at which the next
+	// node would theoretically arrive if nodes were granted at exactly
+	// MaxNumberOfNodesPerMin, with no burst headroom left.
+	theoreticalArrivalTime time.Time
+	// retryAfter holds the duration the last rejected AcquireNodes call
+	// should be retried after.
+	retryAfter time.Duration
+	// lastReserveAt is when AcquireNodes last granted any nodes.
+	lastReserveAt time.Time
+	// reservations holds ReserveNodes grants that have not yet been
+	// confirmed or released; their combined count eats into the GCRA
+	// burst headroom just like a confirmed AcquireNodes grant does.
+	reservations      map[ReservationID]pendingReservation
+	nextReservationID ReservationID
+	mu                sync.Mutex
+}
+
+// emissionInterval is the GCRA emission interval T: the nominal time that
+// must elapse between two single-node arrivals.
+func (t *ScaleUpRateLimiter) emissionInterval() time.Duration {
+	return time.Minute / time.Duration(t.MaxNumberOfNodesPerMin)
+}
+
+// burstTolerance is the GCRA burst tolerance τ: how far the TAT is allowed
+// to run ahead of now before requests start getting throttled.
+func (t *ScaleUpRateLimiter) burstTolerance() time.Duration {
+	return time.Duration(t.BurstMaxNumberOfNodesPerMin-1) * t.emissionInterval()
 }
 
 // AcquireNodes tries to reserve a number of nodes for scale up.
 // The function returns a boolean value indicating whether nodes can be scaled up,
-// and an integer value representing the number of nodes that can be added.
-func (t *ScaleUpRateLimiter) AcquireNodes(newNodes int) (bool, int) {
+// an integer value representing the number of nodes that can be added, and a
+// Reason explaining a refusal (ReasonNone on success).
+//
+// Every call is instrumented with the autoscaler_scaleup_* metrics and, if
+// EventSink is set, reported to it as a structured Event.
+func (t *ScaleUpRateLimiter) AcquireNodes(newNodes int) (bool, int, Reason) {
+	t.mu.Lock()
+	ok, granted, reason := t.acquireLocked(newNodes)
+	if ok {
+		t.lastReserveAt = time.Now()
+	}
+	headroom := t.availableSlotsLocked()
+	lastReserveAt := t.lastReserveAt
+	sink := t.EventSink
+	t.mu.Unlock()
+
+	recordAcquireMetrics(sink, newNodes, granted, reason, headroom, lastReserveAt)
+
+	return ok, granted, reason
+}
+
+// availableSlotsLocked reports how many node slots AcquireNodes could grant
+// right now, without consuming any of them. t.mu must already be held.
+func (t *ScaleUpRateLimiter) availableSlotsLocked() int {
+	if t.MaxNumberOfNodesPerMin <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	interval := t.emissionInterval()
+	tolerance := t.burstTolerance()
+
+	tat := t.theoreticalArrivalTime
+	if tat.Before(now) {
+		tat = now
+	}
+
+	slots := int((interval + tolerance - tat.Sub(now)) / interval)
+	if slots < 0 {
+		slots = 0
+	}
+	return slots
+}
+
+// acquireLocked implements the GCRA admission check shared by AcquireNodes
+// and ReserveNodes. t.mu must already be held.
+func (t *ScaleUpRateLimiter) acquireLocked(newNodes int) (bool, int, Reason) {
+	if newNodes <= 0 || t.MaxNumberOfNodesPerMin <= 0 {
+		return false, 0, ReasonRateLimited
+	}
+
+	if t.HealthProvider != nil {
+		unready, total := t.HealthProvider.UnreadyCount()
+		if unready > t.MaxUnreadyNodes || (total > 0 && float64(unready)/float64(total)*100 > t.MaxUnreadyPercentage) {
+			// The cluster is already struggling; don't pile on more nodes.
+			return false, 0, ReasonTooManyUnready
+		}
+	}
+
+	now := time.Now()
+	interval := t.emissionInterval()
+	tolerance := t.burstTolerance()
+
+	tat := t.theoreticalArrivalTime
+	if tat.Before(now) {
+		tat = now
+	}
+
+	allowedNumNodesToAdd := newNodes
+	newTAT := tat.Add(time.Duration(newNodes) * interval)
+	if newTAT.Sub(now) > interval+tolerance {
+		// Doesn't fit: grant the largest k <= newNodes that does.
+		allowedNumNodesToAdd = int((interval + tolerance - tat.Sub(now)) / interval)
+		if allowedNumNodesToAdd <= 0 {
+			// no quota, can not scale up
+			t.retryAfter = tat.Sub(now) - tolerance
+			return false, 0, ReasonRateLimited
+		}
+		newTAT = tat.Add(time.Duration(allowedNumNodesToAdd) * interval)
+	}
+
+	t.theoreticalArrivalTime = newTAT
+	t.retryAfter = 0
+	return true, allowedNumNodesToAdd, ReasonNone
+}
+
+// RetryAfter returns the duration a caller should wait before the next
+// AcquireNodes call is likely to be granted any quota. It only holds a
+// meaningful value immediately after an AcquireNodes call that returned
+// false.
+func (t *ScaleUpRateLimiter) RetryAfter() time.Duration {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	return t.retryAfter
+}
+
+// ReserveNodes behaves like AcquireNodes, but the granted slots remain
+// pending (still counted against the GCRA burst headroom) until the caller
+// calls ConfirmNodes once the cloud provider has actually created the nodes,
+// or ReleaseNodes if provisioning failed. Reservations left unconfirmed past
+// MaxNodeProvisioningTime are reclaimed by the sweeper (see RunSweeper).
+func (t *ScaleUpRateLimiter) ReserveNodes(newNodes int) (ReservationID, int, Reason) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ok, granted, reason := t.acquireLocked(newNodes)
+	if !ok {
+		return 0, 0, reason
+	}
+
+	t.nextReservationID++
+	id := t.nextReservationID
+	if t.reservations == nil {
+		t.reservations = make(map[ReservationID]pendingReservation)
+	}
+	t.reservations[id] = pendingReservation{
+		count:    granted,
+		deadline: time.Now().Add(t.MaxNodeProvisioningTime),
+	}
+	return id, granted, ReasonNone
+}
+
+// ConfirmNodes marks a ReserveNodes grant as successfully provisioned. Its
+// slots remain spent against the rate limit; only the pending-reservation
+// bookkeeping is cleared.
+func (t *ScaleUpRateLimiter) ConfirmNodes(id ReservationID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.reservations, id)
+}
+
+// ReleaseNodes cancels a ReserveNodes grant, typically because the cloud
+// provider failed synchronously, and returns its slots to the pool so they
+// can be granted again.
+func (t *ScaleUpRateLimiter) ReleaseNodes(id ReservationID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.reservations[id]
+	if !ok {
+		return
+	}
+	delete(t.reservations, id)
+	t.rollbackLocked(r.count)
+}
+
+// rollbackLocked returns count nodes' worth of quota to the pool by rewinding
+// the GCRA TAT. t.mu must already be held.
+func (t *ScaleUpRateLimiter) rollbackLocked(count int) {
+	t.theoreticalArrivalTime = t.theoreticalArrivalTime.Add(-time.Duration(count) * t.emissionInterval())
+}
+
+// RunSweeper periodically reclaims reservations that have sat unconfirmed
+// past their MaxNodeProvisioningTime deadline, returning their slots to the
+// pool and invoking OnReservationExpired for each one. It blocks until ctx
+// is done, so callers should run it in its own goroutine.
+func (t *ScaleUpRateLimiter) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.sweepExpiredReservations()
+		}
+	}
+}
+
+// sweepExpiredReservations reclaims every reservation whose deadline has
+// passed. It returns the number of reservations reclaimed.
+func (t *ScaleUpRateLimiter) sweepExpiredReservations() int {
+	t.mu.Lock()
+	now := time.Now()
+	var expiredIDs []ReservationID
+	var expiredCounts []int
+	for id, r := range t.reservations {
+		if now.After(r.deadline) {
+			expiredIDs = append(expiredIDs, id)
+			expiredCounts = append(expiredCounts, r.count)
+		}
+	}
+	for i, id := range expiredIDs {
+		delete(t.reservations, id)
+		t.rollbackLocked(expiredCounts[i])
+	}
+	hook := t.OnReservationExpired
+	t.mu.Unlock()
+
+	if hook != nil {
+		for i, id := range expiredIDs {
+			hook(id, expiredCounts[i])
+		}
+	}
+	return len(expiredIDs)
+}
+
+// releaseDirect returns count nodes' worth of quota to the pool. Unlike
+// ReleaseNodes, it isn't tied to a ReserveNodes reservation; it backs
+// Reservation.Cancel.
+func (t *ScaleUpRateLimiter) releaseDirect(count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollbackLocked(count)
+}
+
+// Reservation is a grant of node quota returned by Reserve. Unlike
+// AcquireNodes/ReserveNodes, Reserve never partially grants a request once
+// it decides to admit it; it either reports how long the caller must wait
+// before acting on it, or refuses outright via Reason.
+type Reservation struct {
+	limiter  *ScaleUpRateLimiter
+	ok       bool
+	reason   Reason
+	n        int
+	delay    time.Duration
+	canceled bool
+	mu       sync.Mutex
+}
+
+// OK reports whether the reservation is usable. It is false when Reserve was
+// called with an invalid request (n <= 0 or a misconfigured limiter) or when
+// HealthProvider's unready gating refused the request; see Reason.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Reason explains why a reservation isn't OK. It is ReasonNone when OK is
+// true.
+func (r *Reservation) Reason() Reason {
+	return r.reason
+}
+
+// Delay returns how long the caller should wait before treating the
+// reserved nodes as available.
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return 0
+	}
+	return r.delay
+}
+
+// Cancel undoes the reservation, returning its slots to the pool. It is a
+// no-op if the reservation wasn't OK or has already been canceled.
+func (r *Reservation) Cancel() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ok || r.canceled {
+		return
+	}
+	r.canceled = true
+	r.limiter.releaseDirect(r.n)
+}
+
+// Reserve reserves n nodes' worth of quota and reports how long the caller
+// must wait before treating them as available, advancing the GCRA TAT as if
+// the wait already happened. It refuses outright, like AcquireNodes, if n is
+// invalid or HealthProvider's unready gating trips; otherwise it never
+// partially grants. Callers that don't want to wait can call
+// Reservation.Cancel to give the quota back.
+func (t *ScaleUpRateLimiter) Reserve(n int) *Reservation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n <= 0 || t.MaxNumberOfNodesPerMin <= 0 {
+		return &Reservation{ok: false, reason: ReasonRateLimited}
+	}
+
+	if t.HealthProvider != nil {
+		unready, total := t.HealthProvider.UnreadyCount()
+		if unready > t.MaxUnreadyNodes || (total > 0 && float64(unready)/float64(total)*100 > t.MaxUnreadyPercentage) {
+			// The cluster is already struggling; don't pile on more nodes.
+			return &Reservation{ok: false, reason: ReasonTooManyUnready}
+		}
+	}
 
 	now := time.Now()
-	allowedNumNodesToAdd := int(now.Sub(t.LastReserve).Minutes())*t.MaxNumberOfNodesPerMin + t.UnusedNodeSlots
-	if allowedNumNodesToAdd > t.BurstMaxNumberOfNodesPerMin {
-		allowedNumNodesToAdd = t.BurstMaxNumberOfNodesPerMin
+	interval := t.emissionInterval()
+	tolerance := t.burstTolerance()
+
+	tat := t.theoreticalArrivalTime
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTAT := tat.Add(time.Duration(n) * interval)
+	delay := newTAT.Sub(now) - interval - tolerance
+	if delay < 0 {
+		delay = 0
 	}
 
-	if allowedNumNodesToAdd <= 0 {
-		// no quota, can not scale up
-		return false, 0
+	t.theoreticalArrivalTime = newTAT
+	t.retryAfter = 0
+	return &Reservation{limiter: t, ok: true, n: n, delay: delay}
+}
+
+// WaitN blocks until n nodes' worth of quota becomes available or ctx is
+// done, modeled after golang.org/x/time/rate.Limiter.WaitN. On success it
+// returns n, nil; if ctx is canceled first, the reservation is released and
+// WaitN returns 0 and ctx.Err().
+func (t *ScaleUpRateLimiter) WaitN(ctx context.Context, n int) (int, error) {
+	r := t.Reserve(n)
+	if !r.OK() {
+		return 0, fmt.Errorf("scaleup: cannot reserve %d nodes: %s", n, r.Reason())
 	}
 
-	t.LastReserve = now
-	if newNodes > allowedNumNodesToAdd {
-		t.UnusedNodeSlots = 0
-		return true, allowedNumNodesToAdd
+	delay := r.Delay()
+	if delay == 0 {
+		return n, nil
 	}
-	t.UnusedNodeSlots = allowedNumNodesToAdd - newNodes
 
-	return true, newNodes
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return n, nil
+	case <-ctx.Done():
+		r.Cancel()
+		return 0, ctx.Err()
+	}
 }
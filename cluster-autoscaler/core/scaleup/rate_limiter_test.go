@@ -0,0 +1,287 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scaleup
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireNodesExactBurstBoundary(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 10,
+	}
+
+	ok, granted, reason := limiter.AcquireNodes(10)
+	if !ok || granted != 10 || reason != ReasonNone {
+		t.Fatalf("AcquireNodes(10) = (%v, %d, %q), want (true, 10, ReasonNone)", ok, granted, reason)
+	}
+
+	ok, granted, reason = limiter.AcquireNodes(1)
+	if ok || granted != 0 || reason != ReasonRateLimited {
+		t.Fatalf("AcquireNodes(1) after exhausting burst = (%v, %d, %q), want (false, 0, ReasonRateLimited)", ok, granted, reason)
+	}
+}
+
+func TestAcquireNodesClampsToAvailableHeadroom(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 10,
+	}
+
+	// Only 6 slots of headroom remain; asking for 10 should neither be
+	// refused outright nor granted in full, but clamped to the largest k <=
+	// newNodes that fits.
+	ok, granted, reason := limiter.AcquireNodes(4)
+	if !ok || granted != 4 || reason != ReasonNone {
+		t.Fatalf("AcquireNodes(4) = (%v, %d, %q), want (true, 4, ReasonNone)", ok, granted, reason)
+	}
+
+	ok, granted, reason = limiter.AcquireNodes(10)
+	if !ok || granted != 6 || reason != ReasonNone {
+		t.Fatalf("AcquireNodes(10) with 6 slots of headroom left = (%v, %d, %q), want (true, 6, ReasonNone)", ok, granted, reason)
+	}
+}
+
+func TestAcquireNodesZeroMaxNumberOfNodesPerMin(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      0,
+		BurstMaxNumberOfNodesPerMin: 10,
+	}
+
+	ok, granted, reason := limiter.AcquireNodes(1)
+	if ok || granted != 0 || reason != ReasonRateLimited {
+		t.Fatalf("AcquireNodes(1) with MaxNumberOfNodesPerMin=0 = (%v, %d, %q), want (false, 0, ReasonRateLimited)", ok, granted, reason)
+	}
+}
+
+func TestAcquireNodesNegativeRequest(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 10,
+	}
+
+	ok, granted, reason := limiter.AcquireNodes(-1)
+	if ok || granted != 0 || reason != ReasonRateLimited {
+		t.Fatalf("AcquireNodes(-1) = (%v, %d, %q), want (false, 0, ReasonRateLimited)", ok, granted, reason)
+	}
+}
+
+type fakeHealthProvider struct {
+	unready, total int
+}
+
+func (f fakeHealthProvider) UnreadyCount() (int, int) {
+	return f.unready, f.total
+}
+
+func TestAcquireNodesTooManyUnready(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 10,
+		MaxUnreadyNodes:             2,
+		HealthProvider:              fakeHealthProvider{unready: 3, total: 10},
+	}
+
+	ok, granted, reason := limiter.AcquireNodes(1)
+	if ok || granted != 0 || reason != ReasonTooManyUnready {
+		t.Fatalf("AcquireNodes(1) with too many unready nodes = (%v, %d, %q), want (false, 0, ReasonTooManyUnready)", ok, granted, reason)
+	}
+}
+
+func TestReserveNodesConfirmKeepsSlotsSpent(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 5,
+	}
+
+	id, granted, reason := limiter.ReserveNodes(5)
+	if granted != 5 || reason != ReasonNone {
+		t.Fatalf("ReserveNodes(5) = (%d, %d, %q), want (_, 5, ReasonNone)", id, granted, reason)
+	}
+
+	if ok, granted, reason := limiter.AcquireNodes(1); ok {
+		t.Fatalf("AcquireNodes(1) with a pending reservation = (%v, %d, %q), want refused", ok, granted, reason)
+	}
+
+	limiter.ConfirmNodes(id)
+
+	// Confirming only clears the pending-reservation bookkeeping; the slots
+	// stay spent against the rate limit.
+	if ok, granted, reason := limiter.AcquireNodes(1); ok {
+		t.Fatalf("AcquireNodes(1) after ConfirmNodes = (%v, %d, %q), want still refused", ok, granted, reason)
+	}
+}
+
+func TestReserveNodesReleaseReturnsSlots(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 5,
+	}
+
+	id, granted, reason := limiter.ReserveNodes(5)
+	if granted != 5 || reason != ReasonNone {
+		t.Fatalf("ReserveNodes(5) = (_, %d, %q), want (_, 5, ReasonNone)", granted, reason)
+	}
+
+	limiter.ReleaseNodes(id)
+
+	ok, granted, reason := limiter.AcquireNodes(5)
+	if !ok || granted != 5 || reason != ReasonNone {
+		t.Fatalf("AcquireNodes(5) after ReleaseNodes = (%v, %d, %q), want (true, 5, ReasonNone)", ok, granted, reason)
+	}
+}
+
+func TestSweepExpiredReservationsReclaimsAndFiresHook(t *testing.T) {
+	type expiry struct {
+		id    ReservationID
+		count int
+	}
+	var fired []expiry
+
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 5,
+		MaxNodeProvisioningTime:     -time.Millisecond,
+		OnReservationExpired: func(id ReservationID, count int) {
+			fired = append(fired, expiry{id, count})
+		},
+	}
+
+	id, granted, reason := limiter.ReserveNodes(5)
+	if granted != 5 || reason != ReasonNone {
+		t.Fatalf("ReserveNodes(5) = (_, %d, %q), want (_, 5, ReasonNone)", granted, reason)
+	}
+
+	// MaxNodeProvisioningTime is negative, so the reservation's deadline is
+	// already in the past; the sweeper should reclaim it immediately.
+	if n := limiter.sweepExpiredReservations(); n != 1 {
+		t.Fatalf("sweepExpiredReservations() = %d, want 1", n)
+	}
+	if len(fired) != 1 || fired[0].id != id || fired[0].count != 5 {
+		t.Fatalf("OnReservationExpired hook calls = %+v, want [{%d 5}]", fired, id)
+	}
+
+	ok, granted, reason := limiter.AcquireNodes(5)
+	if !ok || granted != 5 || reason != ReasonNone {
+		t.Fatalf("AcquireNodes(5) after sweep = (%v, %d, %q), want (true, 5, ReasonNone)", ok, granted, reason)
+	}
+}
+
+func TestReservationDelayAndCancelRefundsSlot(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 1,
+	}
+
+	r1 := limiter.Reserve(1)
+	if !r1.OK() || r1.Delay() != 0 {
+		t.Fatalf("Reserve(1) on a fresh limiter = (ok=%v, delay=%v), want (true, 0)", r1.OK(), r1.Delay())
+	}
+
+	r2 := limiter.Reserve(1)
+	if !r2.OK() || r2.Delay() <= 0 {
+		t.Fatalf("Reserve(1) with the single slot already reserved = (ok=%v, delay=%v), want (true, >0)", r2.OK(), r2.Delay())
+	}
+
+	// With a burst of 1 no slot is free before or after the Cancel, so the
+	// refund is checked on the TAT, which must move back by one interval.
+	afterReserve := limiter.theoreticalArrivalTime
+	r2.Cancel()
+	afterCancel := limiter.theoreticalArrivalTime
+	if want := afterReserve.Add(-limiter.emissionInterval()); !afterCancel.Equal(want) {
+		t.Fatalf("TAT after Cancel = %v, want %v (the slot should be refunded)", afterCancel, want)
+	}
+
+	// Cancel is a no-op the second time and for a reservation that was
+	// never OK.
+	r2.Cancel()
+	limiter.Reserve(0).Cancel()
+	if got := limiter.theoreticalArrivalTime; !got.Equal(afterCancel) {
+		t.Fatalf("TAT after a second Cancel = %v, want unchanged at %v", got, afterCancel)
+	}
+}
+
+func TestWaitNBlocksUntilQuotaFrees(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		// interval = 10ms, no burst tolerance: the second node must wait a
+		// full interval.
+		MaxNumberOfNodesPerMin:      6000,
+		BurstMaxNumberOfNodesPerMin: 1,
+	}
+
+	ctx := context.Background()
+	n, err := limiter.WaitN(ctx, 1)
+	if err != nil || n != 1 {
+		t.Fatalf("first WaitN(ctx, 1) = (%d, %v), want (1, nil)", n, err)
+	}
+
+	start := time.Now()
+	n, err = limiter.WaitN(ctx, 1)
+	elapsed := time.Since(start)
+	if err != nil || n != 1 {
+		t.Fatalf("second WaitN(ctx, 1) = (%d, %v), want (1, nil)", n, err)
+	}
+	if elapsed < 5*time.Millisecond {
+		t.Fatalf("second WaitN(ctx, 1) returned after %v, want it to have actually waited out its ~10ms delay", elapsed)
+	}
+}
+
+func TestWaitNCanceledContextRefundsSlot(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		// interval = 10s: the second node's delay vastly outlasts the ctx
+		// timeout below, so WaitN must return via the ctx.Done() path.
+		MaxNumberOfNodesPerMin:      6,
+		BurstMaxNumberOfNodesPerMin: 1,
+	}
+
+	if n, err := limiter.WaitN(context.Background(), 1); err != nil || n != 1 {
+		t.Fatalf("first WaitN(ctx, 1) = (%d, %v), want (1, nil)", n, err)
+	}
+	before := limiter.theoreticalArrivalTime
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	n, err := limiter.WaitN(ctx, 1)
+	if err == nil || n != 0 {
+		t.Fatalf("WaitN(ctx, 1) with a ctx that times out before the delay elapses = (%d, %v), want (0, a non-nil error)", n, err)
+	}
+
+	// The canceled reservation's slot must be handed back, not left spent.
+	if after := limiter.theoreticalArrivalTime; !after.Equal(before) {
+		t.Fatalf("TAT after a canceled WaitN = %v, want unchanged at %v", after, before)
+	}
+}
+
+func TestReserveRefusesOnTooManyUnready(t *testing.T) {
+	limiter := &ScaleUpRateLimiter{
+		MaxNumberOfNodesPerMin:      60,
+		BurstMaxNumberOfNodesPerMin: 10,
+		MaxUnreadyNodes:             2,
+		HealthProvider:              fakeHealthProvider{unready: 3, total: 10},
+	}
+
+	r := limiter.Reserve(1)
+	if r.OK() {
+		t.Fatalf("Reserve(1) with too many unready nodes returned OK, want refused")
+	}
+	if r.Reason() != ReasonTooManyUnready {
+		t.Fatalf("Reserve(1).Reason() = %q, want ReasonTooManyUnready", r.Reason())
+	}
+}